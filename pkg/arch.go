@@ -0,0 +1,217 @@
+package xdeb
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	archMagicXz   = []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A}
+	archMagicZstd = []byte{0x28, 0xB5, 0x2F, 0xFD}
+	archMagicGzip = []byte{0x1F, 0x8B}
+)
+
+// archDecompressReader wraps body in the decompressor matching a pacman
+// database tarball's magic bytes, since mirrors don't always agree with
+// the extension they publish the file under.
+func archDecompressReader(body io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(body)
+	magic, err := buffered.Peek(6)
+
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, archMagicXz):
+		return xz.NewReader(buffered)
+	case bytes.HasPrefix(magic, archMagicZstd):
+		decoder, err := zstd.NewReader(buffered)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder, nil
+	case bytes.HasPrefix(magic, archMagicGzip):
+		return gzip.NewReader(buffered)
+	default:
+		return nil, fmt.Errorf("Unrecognized pacman database compression")
+	}
+}
+
+// parseArchDesc parses one pacman "desc" entry, a sequence of
+// "%FIELD%\nvalue\n\n" blocks (some, like %DEPENDS%, carrying one value per
+// line), into an XdebPackageDefinition. urlPrefix is the already-expanded
+// repo path the package's Filename is relative to.
+func parseArchDesc(urlPrefix string, desc []byte) XdebPackageDefinition {
+	fields := map[string][]string{}
+	var key string
+
+	for _, line := range strings.Split(string(desc), "\n") {
+		if strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") {
+			key = strings.Trim(line, "%")
+			continue
+		}
+
+		if line == "" {
+			key = ""
+			continue
+		}
+
+		if key == "" {
+			continue
+		}
+
+		fields[key] = append(fields[key], line)
+	}
+
+	first := func(key string) string {
+		if values := fields[key]; len(values) > 0 {
+			return values[0]
+		}
+
+		return ""
+	}
+
+	csize, _ := strconv.ParseInt(first("CSIZE"), 10, 64)
+
+	return XdebPackageDefinition{
+		Name:    first("NAME"),
+		Version: first("VERSION"),
+		Url:     fmt.Sprintf("%s/%s", urlPrefix, first("FILENAME")),
+		Sha256:  first("SHA256SUM"),
+		Csize:   csize,
+		Depends: fields["DEPENDS"],
+	}
+}
+
+// expandArchPath substitutes $repo and $arch in a provider's path template,
+// e.g. "$repo/os/$arch", so mirrors publishing under non-Debian layouts can
+// be described without hardcoding them here.
+func expandArchPath(pathTemplate string, repo string, architecture string) string {
+	if pathTemplate == "" {
+		pathTemplate = "os/$arch"
+	}
+
+	replacer := strings.NewReplacer("$repo", repo, "$arch", architecture)
+	return replacer.Replace(pathTemplate)
+}
+
+func pullArchRepository(ctx context.Context, directory string, urlPrefix string, pathTemplate string, repo string, architecture string) (int64, error) {
+	repoPath := expandArchPath(pathTemplate, repo, architecture)
+	dbUrlPrefix := fmt.Sprintf("%s/%s", urlPrefix, repoPath)
+
+	var dbUrl string
+	var resp *http.Response
+	var err error
+
+	for _, suffix := range []string{".db.tar.zst", ".db.tar.xz", ".db.tar.gz"} {
+		dbUrl = fmt.Sprintf("%s/%s%s", dbUrlPrefix, repo, suffix)
+		req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, dbUrl, nil)
+
+		if reqErr != nil {
+			return 0, reqErr
+		}
+
+		resp, err = http.DefaultClient.Do(req)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if resp.StatusCode == 200 {
+			break
+		}
+
+		resp.Body.Close()
+	}
+
+	if resp == nil || resp.StatusCode != 200 {
+		if resp != nil && resp.StatusCode >= 500 {
+			return 0, &HTTPStatusError{URL: dbUrl, StatusCode: resp.StatusCode}
+		}
+
+		return 0, nil
+	}
+
+	defer resp.Body.Close()
+
+	counter := &countingReader{r: resp.Body}
+	reader, err := archDecompressReader(counter)
+
+	if err != nil {
+		return 0, err
+	}
+
+	definition := XdebProviderDefinition{}
+	tarReader := tar.NewReader(reader)
+
+	for {
+		header, err := tarReader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return counter.n, err
+		}
+
+		if !strings.HasSuffix(header.Name, "/desc") {
+			continue
+		}
+
+		desc, err := io.ReadAll(tarReader)
+
+		if err != nil {
+			return counter.n, err
+		}
+
+		definition.Xdeb = append(definition.Xdeb, parseArchDesc(dbUrlPrefix, desc))
+	}
+
+	if len(definition.Xdeb) > 0 {
+		LogMessage("Syncing repository %s: %s", filepath.Base(directory), repo)
+
+		filePath := filepath.Join(directory, repo, fmt.Sprintf("%s.yaml", repo))
+		data, err := yaml.Marshal(definition)
+
+		if err != nil {
+			return counter.n, err
+		}
+
+		if _, err = writeFile(filePath, data, true); err != nil {
+			return counter.n, err
+		}
+	}
+
+	return counter.n, nil
+}
+
+// countingReader wraps an io.Reader to track how many bytes have passed
+// through it, so callers upstream of a decompressor can still report raw
+// network bytes transferred.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
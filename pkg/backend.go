@@ -0,0 +1,313 @@
+package xdeb
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/yargevad/filepathx"
+)
+
+// PackageRef names one file a Backend can List or Open, independent of how
+// the backend actually stores it (local disk, object storage, WebDAV, ...).
+type PackageRef struct {
+	Name string
+	Url  string
+}
+
+// Backend abstracts where package payloads live, so providers aren't
+// limited to public HTTP(S) mirrors: a corporate S3 bucket or a mounted
+// NFS/WebDAV share of vendored .debs works the same way.
+type Backend interface {
+	List(ctx context.Context) ([]PackageRef, error)
+	Open(ctx context.Context, ref PackageRef) (io.ReadCloser, error)
+}
+
+// NewBackend selects a Backend implementation based on baseUrl's scheme:
+// http(s)://, file://, s3://, or webdav(s)://.
+func NewBackend(baseUrl string) (Backend, error) {
+	parsed, err := url.Parse(baseUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsed.Scheme {
+	case "http", "https":
+		return &httpBackend{baseUrl: baseUrl}, nil
+	case "file":
+		return &fileBackend{root: filepath.FromSlash(parsed.Path)}, nil
+	case "s3":
+		return &s3Backend{bucket: parsed.Host, prefix: strings.TrimPrefix(parsed.Path, "/")}, nil
+	case "webdav", "webdavs":
+		scheme := "http"
+
+		if parsed.Scheme == "webdavs" {
+			scheme = "https"
+		}
+
+		return &webdavBackend{baseUrl: fmt.Sprintf("%s://%s%s", scheme, parsed.Host, parsed.Path)}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported backend scheme for %s", baseUrl)
+	}
+}
+
+// httpBackend treats baseUrl as a single opaque file, matching the
+// historical behavior of pullCustomRepository: no directory listing is
+// possible over plain HTTP, so List just returns baseUrl itself.
+type httpBackend struct {
+	baseUrl string
+}
+
+func (b *httpBackend) List(ctx context.Context) ([]PackageRef, error) {
+	return []PackageRef{{Name: filepath.Base(b.baseUrl), Url: b.baseUrl}}, nil
+}
+
+func (b *httpBackend) Open(ctx context.Context, ref PackageRef) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref.Url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not download file %s", ref.Url)
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Could not download file %s", ref.Url)
+	}
+
+	return resp.Body, nil
+}
+
+// fileBackend serves packages out of a local directory, for airgapped
+// installs off a mounted drive or NFS share.
+type fileBackend struct {
+	root string
+}
+
+func (b *fileBackend) List(ctx context.Context) ([]PackageRef, error) {
+	matches, err := filepathx.Glob(filepath.Join(b.root, "**", "*.deb"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]PackageRef, len(matches))
+
+	for i, match := range matches {
+		refs[i] = PackageRef{Name: filepath.Base(match), Url: "file://" + match}
+	}
+
+	return refs, nil
+}
+
+func (b *fileBackend) Open(ctx context.Context, ref PackageRef) (io.ReadCloser, error) {
+	return os.Open(strings.TrimPrefix(ref.Url, "file://"))
+}
+
+// s3Backend lists and fetches packages from a public-read S3-compatible
+// bucket via its plain REST API. Buckets requiring SigV4-authenticated
+// requests aren't supported yet.
+type s3Backend struct {
+	bucket string
+	prefix string
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+}
+
+func (b *s3Backend) endpoint() string {
+	return fmt.Sprintf("https://%s.s3.amazonaws.com", b.bucket)
+}
+
+func (b *s3Backend) List(ctx context.Context) ([]PackageRef, error) {
+	listUrl := fmt.Sprintf("%s?list-type=2&prefix=%s", b.endpoint(), url.QueryEscape(b.prefix))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listUrl, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Could not list bucket %s", b.bucket)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result s3ListBucketResult
+
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+
+	refs := []PackageRef{}
+
+	for _, object := range result.Contents {
+		if !strings.HasSuffix(object.Key, ".deb") {
+			continue
+		}
+
+		refs = append(refs, PackageRef{
+			Name: path.Base(object.Key),
+			Url:  fmt.Sprintf("%s/%s", b.endpoint(), object.Key),
+		})
+	}
+
+	return refs, nil
+}
+
+func (b *s3Backend) Open(ctx context.Context, ref PackageRef) (io.ReadCloser, error) {
+	objectUrl := ref.Url
+
+	if parsed, err := url.Parse(ref.Url); err == nil && parsed.Scheme == "s3" {
+		objectUrl = fmt.Sprintf("https://%s.s3.amazonaws.com%s", parsed.Host, parsed.Path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectUrl, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Could not download object %s", objectUrl)
+	}
+
+	return resp.Body, nil
+}
+
+// webdavBackend lists and fetches packages from a WebDAV share via PROPFIND
+// and GET.
+type webdavBackend struct {
+	baseUrl string
+}
+
+type webdavMultistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+	} `xml:"response"`
+}
+
+func (b *webdavBackend) List(ctx context.Context) ([]PackageRef, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", b.baseUrl, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Depth", "1")
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 207 && resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Could not list WebDAV collection %s", b.baseUrl)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var multistatus webdavMultistatus
+
+	if err := xml.Unmarshal(body, &multistatus); err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(b.baseUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []PackageRef{}
+
+	for _, response := range multistatus.Responses {
+		if !strings.HasSuffix(response.Href, ".deb") {
+			continue
+		}
+
+		href, err := base.Parse(response.Href)
+
+		if err != nil {
+			continue
+		}
+
+		refs = append(refs, PackageRef{Name: path.Base(response.Href), Url: href.String()})
+	}
+
+	return refs, nil
+}
+
+func (b *webdavBackend) Open(ctx context.Context, ref PackageRef) (io.ReadCloser, error) {
+	fileUrl := ref.Url
+
+	if parsed, err := url.Parse(ref.Url); err == nil && (parsed.Scheme == "webdav" || parsed.Scheme == "webdavs") {
+		parsed.Scheme = "http"
+
+		if strings.HasPrefix(ref.Url, "webdavs:") {
+			parsed.Scheme = "https"
+		}
+
+		fileUrl = parsed.String()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileUrl, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Could not download file %s", fileUrl)
+	}
+
+	return resp.Body, nil
+}
@@ -0,0 +1,50 @@
+package xdeb
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// packagesCacheMeta is the sidecar persisted next to a cached Packages
+// file so repeat syncs can send If-Modified-Since/If-None-Match and skip
+// re-parsing an upstream that hasn't changed.
+type packagesCacheMeta struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+	Sha256       string `json:"sha256"`
+}
+
+func packagesCacheMetaPath(filePath string) string {
+	return filePath + ".meta"
+}
+
+func loadPackagesCacheMeta(filePath string) *packagesCacheMeta {
+	data, err := os.ReadFile(packagesCacheMetaPath(filePath))
+
+	if err != nil {
+		return nil
+	}
+
+	meta := &packagesCacheMeta{}
+
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil
+	}
+
+	return meta
+}
+
+func savePackagesCacheMeta(filePath string, meta *packagesCacheMeta) error {
+	data, err := json.Marshal(meta)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+
+	return os.WriteFile(packagesCacheMetaPath(filePath), data, 0644)
+}
@@ -0,0 +1,528 @@
+package xdeb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// downloadChunkCount is how many concurrent Range requests a single
+	// download is split into when the server supports them.
+	downloadChunkCount = 4
+
+	// downloadMinChunkSize keeps small files from being split into chunks
+	// tinier than the HTTP overhead of fetching them is worth.
+	downloadMinChunkSize = 1 << 20 // 1 MiB
+)
+
+// Progress reports the state of an in-progress download, e.g. for a CLI
+// progress bar. Update may be called from multiple chunk goroutines.
+type Progress interface {
+	Update(done int64, total int64, speed float64)
+}
+
+// HTTPStatusError reports a non-2xx, non-304 HTTP response, preserving the
+// status code so callers like isTransientSyncError can tell a transient 5xx
+// apart from a permanent 4xx instead of only seeing an opaque error string.
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("Unexpected status %d for %s", e.StatusCode, e.URL)
+}
+
+// downloadChunk is one byte-range slice of a file being fetched concurrently.
+type downloadChunk struct {
+	start int64
+	end   int64 // inclusive
+}
+
+// probeDownload issues a HEAD request to learn a download's size and
+// whether the server supports resuming/splitting it via Range requests.
+func probeDownload(ctx context.Context, client *http.Client, url string) (size int64, acceptRanges bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return 0, false, &HTTPStatusError{URL: url, StatusCode: resp.StatusCode}
+	}
+
+	return resp.ContentLength, resp.Header.Get("Accept-Ranges") == "bytes", nil
+}
+
+func splitChunks(size int64, count int) []downloadChunk {
+	chunkSize := size / int64(count)
+	chunks := make([]downloadChunk, 0, count)
+	offset := int64(0)
+
+	for i := 0; i < count; i++ {
+		end := offset + chunkSize - 1
+
+		if i == count-1 {
+			end = size - 1
+		}
+
+		chunks = append(chunks, downloadChunk{start: offset, end: end})
+		offset = end + 1
+	}
+
+	return chunks
+}
+
+// downloadProgressMeta persists how many bytes of each Range chunk have
+// already been written to a .part file, so a retried downloadChunked can
+// shrink each chunk's Range request to just the bytes still missing instead
+// of redownloading a chunk that died partway through.
+type downloadProgressMeta struct {
+	Chunks []int64 `json:"chunks"`
+}
+
+func downloadProgressPath(partPath string) string {
+	return partPath + ".progress"
+}
+
+// loadDownloadProgress reads the progress sidecar for partPath. found is
+// false if there isn't one, or if it doesn't match chunkCount (e.g. left
+// over from a differently-sized attempt), in which case chunks is a fresh
+// all-zero slice.
+func loadDownloadProgress(partPath string, chunkCount int) (chunks []int64, found bool) {
+	data, err := os.ReadFile(downloadProgressPath(partPath))
+
+	if err != nil {
+		return make([]int64, chunkCount), false
+	}
+
+	meta := downloadProgressMeta{}
+
+	if err := json.Unmarshal(data, &meta); err != nil || len(meta.Chunks) != chunkCount {
+		return make([]int64, chunkCount), false
+	}
+
+	return meta.Chunks, true
+}
+
+func saveDownloadProgress(partPath string, chunks []int64) error {
+	data, err := json.Marshal(downloadProgressMeta{Chunks: chunks})
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(downloadProgressPath(partPath), data, 0644)
+}
+
+// fetchRange downloads the portion of [chunk.start, chunk.end] starting
+// resumeFrom bytes in, and writes it into partFile at the matching offset,
+// reporting cumulative progress through tracker. It is safe to call
+// concurrently for disjoint chunks of the same partFile. It returns the
+// number of bytes written by this call, even when it returns an error, so a
+// caller can persist how far this chunk got before failing.
+func fetchRange(ctx context.Context, client *http.Client, url string, chunk downloadChunk, resumeFrom int64, partFile *os.File, tracker *progressTracker) (int64, error) {
+	start := chunk.start + resumeFrom
+
+	if start > chunk.end {
+		return 0, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, chunk.end))
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return 0, &HTTPStatusError{URL: url, StatusCode: resp.StatusCode}
+	}
+
+	writer := io.NewOffsetWriter(partFile, start)
+	counting := &countingWriter{w: writer, tracker: tracker}
+	return io.Copy(counting, resp.Body)
+}
+
+// countingWriter forwards writes to w while reporting bytes written to a
+// shared progressTracker, so concurrent chunk downloads can report a single
+// combined progress figure.
+type countingWriter struct {
+	w       io.Writer
+	tracker *progressTracker
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.tracker.add(int64(n))
+	return n, err
+}
+
+// progressTracker aggregates bytes written across chunk downloads and
+// periodically reports done/total/speed to a Progress.
+type progressTracker struct {
+	mu       sync.Mutex
+	done     int64
+	total    int64
+	progress Progress
+	started  time.Time
+}
+
+func newProgressTracker(total int64, progress Progress) *progressTracker {
+	if progress == nil {
+		progress = noopProgress{}
+	}
+
+	return &progressTracker{total: total, progress: progress, started: time.Now()}
+}
+
+func (t *progressTracker) add(n int64) {
+	t.mu.Lock()
+	t.done += n
+	done := t.done
+	elapsed := time.Since(t.started).Seconds()
+	t.mu.Unlock()
+
+	speed := float64(0)
+
+	if elapsed > 0 {
+		speed = float64(done) / elapsed
+	}
+
+	t.progress.Update(done, t.total, speed)
+}
+
+type noopProgress struct{}
+
+func (noopProgress) Update(done int64, total int64, speed float64) {}
+
+// downloadChunked fetches url into partPath using downloadChunkCount
+// concurrent Range requests, resuming a previous attempt from its progress
+// sidecar: each chunk's Range request is shrunk to just the bytes that
+// weren't already written by an earlier, interrupted attempt, rather than
+// refetching the whole chunk. If partPath is already complete but has no
+// progress sidecar (e.g. left over from before per-chunk tracking), it's
+// trusted as done the same way a prior attempt would have left it.
+func downloadChunked(ctx context.Context, client *http.Client, url string, partPath string, size int64, progress Progress) error {
+	if err := os.MkdirAll(filepath.Dir(partPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Stat before opening: OpenFile creates partPath and Truncate below
+	// resizes it, so its size afterwards says nothing about earlier attempts.
+	existingSize := int64(-1)
+
+	if existing, err := os.Stat(partPath); err == nil {
+		existingSize = existing.Size()
+	}
+
+	partFile, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer partFile.Close()
+
+	if err := partFile.Truncate(size); err != nil {
+		return err
+	}
+
+	chunkCount := downloadChunkCount
+
+	if size/int64(chunkCount) < downloadMinChunkSize {
+		chunkCount = 1
+	}
+
+	chunks := splitChunks(size, chunkCount)
+	resumed, found := loadDownloadProgress(partPath, len(chunks))
+
+	if !found && existingSize == size {
+		for i, chunk := range chunks {
+			resumed[i] = chunk.end - chunk.start + 1
+		}
+	}
+
+	var alreadyDone int64
+	type pendingChunk struct {
+		index int
+		chunk downloadChunk
+	}
+	pending := []pendingChunk{}
+
+	for i, chunk := range chunks {
+		chunkSize := chunk.end - chunk.start + 1
+
+		if resumed[i] > chunkSize {
+			resumed[i] = chunkSize
+		}
+
+		alreadyDone += resumed[i]
+
+		if resumed[i] < chunkSize {
+			pending = append(pending, pendingChunk{index: i, chunk: chunk})
+		}
+	}
+
+	if alreadyDone == size {
+		os.Remove(downloadProgressPath(partPath))
+		return nil
+	}
+
+	tracker := newProgressTracker(size, progress)
+	tracker.done = alreadyDone
+
+	errs := make(chan error, len(pending))
+	var progressMu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, p := range pending {
+		wg.Add(1)
+
+		go func(p pendingChunk) {
+			defer wg.Done()
+			written, err := fetchRange(ctx, client, url, p.chunk, resumed[p.index], partFile, tracker)
+
+			progressMu.Lock()
+			resumed[p.index] += written
+			_ = saveDownloadProgress(partPath, resumed)
+			progressMu.Unlock()
+
+			errs <- err
+		}(p)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	var joined error
+
+	for err := range errs {
+		if err != nil {
+			joined = errors.Join(joined, err)
+		}
+	}
+
+	if joined == nil {
+		os.Remove(downloadProgressPath(partPath))
+	}
+
+	return joined
+}
+
+// downloadWhole fetches url as a single stream, the fallback for servers
+// that don't advertise Range support or don't report a Content-Length.
+func downloadWhole(ctx context.Context, client *http.Client, url string, partPath string, progress Progress) error {
+	if err := os.MkdirAll(filepath.Dir(partPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("Could not download file %s", url)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return &HTTPStatusError{URL: url, StatusCode: resp.StatusCode}
+	}
+
+	partFile, err := os.Create(partPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer partFile.Close()
+
+	tracker := newProgressTracker(resp.ContentLength, progress)
+	_, err = io.Copy(&countingWriter{w: partFile, tracker: tracker}, resp.Body)
+	return err
+}
+
+// downloadViaBackend fetches candidateUrl into partPath through the Backend
+// matching its scheme, for sources (file://, s3://, webdav(s)://) that don't
+// speak plain HTTP Range requests and so can't use the chunked/resumable path.
+func downloadViaBackend(ctx context.Context, candidateUrl string, partPath string, progress Progress) error {
+	if err := os.MkdirAll(filepath.Dir(partPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	backend, err := NewBackend(candidateUrl)
+
+	if err != nil {
+		return err
+	}
+
+	reader, err := backend.Open(ctx, PackageRef{Url: candidateUrl})
+
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	partFile, err := os.Create(partPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer partFile.Close()
+
+	tracker := newProgressTracker(0, progress)
+	_, err = io.Copy(&countingWriter{w: partFile, tracker: tracker}, reader)
+	return err
+}
+
+// downloadCandidate attempts a full, checksum-verified download of url into
+// path. Plain HTTP(S) URLs whose server reports a size and Range support use
+// the chunked path, which resumes from the .part file left by a previous
+// attempt; any other scheme is dispatched through the matching Backend
+// instead. The single-stream and Backend paths do not resume: they recreate
+// the .part file and fetch the whole file again.
+func downloadCandidate(ctx context.Context, candidateUrl string, path string, expectedSha256 string, progress Progress) (string, error) {
+	fullPath := filepath.Join(path, filepath.Base(candidateUrl))
+	partPath := fullPath + ".part"
+
+	parsed, err := url.Parse(candidateUrl)
+
+	if err != nil {
+		return "", err
+	}
+
+	switch parsed.Scheme {
+	case "", "http", "https":
+		client := &http.Client{}
+		size, acceptRanges, err := probeDownload(ctx, client, candidateUrl)
+
+		if err == nil && acceptRanges && size > 0 {
+			err = downloadChunked(ctx, client, candidateUrl, partPath, size, progress)
+		} else {
+			err = downloadWhole(ctx, client, candidateUrl, partPath, progress)
+		}
+
+		if err != nil {
+			return "", err
+		}
+	default:
+		if err := downloadViaBackend(ctx, candidateUrl, partPath, progress); err != nil {
+			return "", err
+		}
+	}
+
+	if expectedSha256 != "" {
+		data, err := os.ReadFile(partPath)
+
+		if err != nil {
+			return "", err
+		}
+
+		if err := verifySha256(fullPath, data, expectedSha256); err != nil {
+			os.Remove(partPath)
+			os.Remove(downloadProgressPath(partPath))
+			return "", err
+		}
+	}
+
+	if err := os.Rename(partPath, fullPath); err != nil {
+		return "", err
+	}
+
+	return fullPath, nil
+}
+
+// DownloadFile downloads url into path, resuming an interrupted attempt
+// from its on-disk .part file and splitting the transfer into concurrent
+// Range requests when the server supports it. If expectedSha256 is
+// non-empty, the downloaded bytes are verified against it; a mismatch
+// returns *ChecksumMismatchError. If followRedirects is set, the initial
+// URL is first resolved to its final location. mirrors, if given, are tried
+// in order after url on any download or checksum failure. The result is
+// optionally zstd-compressed on disk via compress. Non-HTTP(S) URLs (and
+// mirrors) are dispatched through the Backend matching their scheme, so
+// file://, s3://, and webdav(s):// sources work the same way plain mirrors do.
+func DownloadFile(ctx context.Context, path string, url string, followRedirects bool, compress bool, expectedSha256 string, mirrors []string, progress Progress) (string, error) {
+	if followRedirects {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+		if err != nil {
+			return "", err
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			return "", fmt.Errorf("Could not download file %s", url)
+		}
+
+		resp.Body.Close()
+		url = resp.Request.URL.String()
+	}
+
+	candidates := append([]string{url}, mirrors...)
+	var lastErr error
+
+	for _, candidate := range candidates {
+		fullPath, err := downloadCandidate(ctx, candidate, path, expectedSha256, progress)
+
+		if err == nil {
+			if !compress {
+				return fullPath, nil
+			}
+
+			data, err := os.ReadFile(fullPath)
+
+			if err != nil {
+				return "", err
+			}
+
+			compressedPath, err := writeFile(fullPath, data, true)
+
+			if err != nil {
+				return "", err
+			}
+
+			os.Remove(fullPath)
+			return compressedPath, nil
+		}
+
+		lastErr = err
+	}
+
+	return "", lastErr
+}
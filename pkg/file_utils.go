@@ -5,7 +5,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 
@@ -110,36 +109,3 @@ func writeFile(path string, data []byte, compress bool) (string, error) {
 
 	return fullPath, err
 }
-
-func DownloadFile(path string, url string, followRedirects bool, compress bool) (string, error) {
-	client := &http.Client{}
-	resp, err := client.Get(url)
-
-	if err != nil {
-		return "", fmt.Errorf("Could not download file %s", url)
-	}
-
-	if followRedirects {
-		url = resp.Request.URL.String()
-		resp, err = client.Get(url)
-
-		if err != nil {
-			return "", fmt.Errorf("Could not download file %s", url)
-		}
-	}
-
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("Could not download file %s", url)
-	}
-
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-
-	if err != nil {
-		return "", err
-	}
-
-	fullPath := filepath.Join(path, filepath.Base(url))
-	return writeFile(fullPath, body, compress)
-}
@@ -1,13 +1,25 @@
 package xdeb
 
 import (
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/ulikunitz/xz"
 	"golang.org/x/exp/slices"
@@ -21,12 +33,53 @@ type PackageListsProvider struct {
 	Architecture  string   `yaml:"architecture"`
 	Components    []string `yaml:"components"`
 	Distributions []string `yaml:"dists"`
+
+	// Kind selects the repository format: "apt" (default), "custom",
+	// "arch" for pacman repositories, or "directory" to list raw .deb
+	// files straight off a Backend (file://, s3://, webdav(s)://) without
+	// any index at all. Takes precedence over Custom. Url and Mirrors are
+	// dispatched through the Backend matching their scheme, so any of
+	// these kinds can be served over file://, s3://, or webdav(s):// in
+	// addition to plain HTTP(S).
+	Kind string `yaml:"kind"`
+
+	// Path is a template for the directory a repository is published
+	// under, e.g. "$repo/os/$arch". Only consulted for Kind "arch";
+	// defaults to pacman's own "os/$arch" layout.
+	Path string `yaml:"path"`
+
+	// Mirrors are alternate base URLs tried, in order, after Url fails.
+	// Only Kind "custom" consults them; apt, arch and directory providers
+	// fetch from Url alone.
+	Mirrors []string `yaml:"mirrors"`
+
+	// Keyring is the path to an armored or binary OpenPGP keyring used to
+	// verify the provider's Release/InRelease file. Ignored if Trusted is set.
+	Keyring string `yaml:"keyring"`
+
+	// Trusted opts out of Release/InRelease signature verification for
+	// providers that don't publish one, e.g. local or vendored mirrors.
+	Trusted bool `yaml:"trusted"`
 }
 
 type PackageListsDefinition struct {
 	Providers []PackageListsProvider `yaml:"providers"`
 }
 
+// providerKind resolves the effective repository format for p, falling
+// back to the legacy Custom bool when Kind isn't set.
+func providerKind(p PackageListsProvider) string {
+	if p.Kind != "" {
+		return p.Kind
+	}
+
+	if p.Custom {
+		return "custom"
+	}
+
+	return "apt"
+}
+
 func parsePackagesFile(urlPrefix string, packages_file string) *XdebProviderDefinition {
 	definition := XdebProviderDefinition{}
 	packages := strings.Split(packages_file, "\n\n")
@@ -75,115 +128,327 @@ func parsePackagesFile(urlPrefix string, packages_file string) *XdebProviderDefi
 	return &definition
 }
 
-func pullPackagesFile(urlPrefix string, dist string, component string, architecture string) (*XdebProviderDefinition, error) {
+// pullPackagesFile fetches a component's Packages file, sending
+// If-Modified-Since/If-None-Match from cached if set. A 304 response short
+// circuits parsing entirely: it returns a nil definition, cacheHit true,
+// and the caller reuses whatever it already has on disk. urlPrefix's scheme
+// decides how the file is actually fetched: plain HTTP(S) uses conditional
+// GETs directly, anything else (file://, s3://, webdav(s)://) goes through
+// the matching Backend, which doesn't support conditional requests.
+func pullPackagesFile(ctx context.Context, urlPrefix string, dist string, component string, architecture string, checksums map[string]releaseFileEntry, trusted bool, cached *packagesCacheMeta) (definition *XdebProviderDefinition, bytesDownloaded int64, cacheHit bool, meta *packagesCacheMeta, err error) {
 	url := fmt.Sprintf(
 		"%s/dists/%s/%s/binary-%s/Packages",
 		urlPrefix, dist, component, architecture,
 	)
 
-	resp, err := http.Get(url)
+	relPath := fmt.Sprintf("%s/binary-%s/Packages", component, architecture)
+
+	parsed, err := neturl.Parse(urlPrefix)
 
 	if err != nil {
-		return nil, err
+		return nil, 0, false, nil, err
 	}
 
-	if resp.StatusCode != 200 {
-		resp, err = http.Get(fmt.Sprintf("%s.xz", url))
+	var body []byte
+	var newMeta *packagesCacheMeta
+
+	if parsed.Scheme != "" && parsed.Scheme != "http" && parsed.Scheme != "https" {
+		body, relPath, err = pullPackagesFileViaBackend(ctx, url, relPath)
 
 		if err != nil {
-			return nil, err
+			return nil, 0, false, nil, err
+		}
+
+		if body == nil {
+			return nil, 0, false, nil, nil
+		}
+
+		newMeta = &packagesCacheMeta{}
+	} else {
+		get := func(candidate string) (*http.Response, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, candidate, nil)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if cached != nil {
+				if cached.ETag != "" {
+					req.Header.Set("If-None-Match", cached.ETag)
+				}
+
+				if cached.LastModified != "" {
+					req.Header.Set("If-Modified-Since", cached.LastModified)
+				}
+			}
+
+			return http.DefaultClient.Do(req)
 		}
-	}
 
-	if resp.StatusCode != 200 {
-		resp, err = http.Get(fmt.Sprintf("%s.gz", url))
+		resp, err := get(url)
 
 		if err != nil {
-			return nil, err
+			return nil, 0, false, nil, err
 		}
-	}
 
-	if resp.StatusCode != 200 {
-		return nil, nil
-	}
+		if resp.StatusCode != 200 && resp.StatusCode != http.StatusNotModified {
+			relPath += ".xz"
+			resp, err = get(fmt.Sprintf("%s.xz", url))
 
-	defer resp.Body.Close()
+			if err != nil {
+				return nil, 0, false, nil, err
+			}
+		}
 
-	requestUrl := fmt.Sprintf(
-		"%s://%s%s",
-		resp.Request.URL.Scheme, resp.Request.URL.Host, resp.Request.URL.Path,
-	)
+		if resp.StatusCode != 200 && resp.StatusCode != http.StatusNotModified {
+			relPath = strings.TrimSuffix(relPath, ".xz") + ".gz"
+			resp, err = get(fmt.Sprintf("%s.gz", url))
 
-	var reader io.Reader
+			if err != nil {
+				return nil, 0, false, nil, err
+			}
+		}
+
+		if resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			return nil, 0, true, cached, nil
+		}
+
+		if resp.StatusCode != 200 {
+			defer resp.Body.Close()
+
+			if resp.StatusCode >= 500 {
+				return nil, 0, false, nil, &HTTPStatusError{URL: url, StatusCode: resp.StatusCode}
+			}
+
+			return nil, 0, false, nil, nil
+		}
 
-	if strings.HasSuffix(requestUrl, ".xz") {
-		reader, err = xz.NewReader(resp.Body)
+		defer resp.Body.Close()
+
+		body, err = io.ReadAll(resp.Body)
 
 		if err != nil {
-			return nil, err
+			return nil, 0, false, nil, err
+		}
+
+		newMeta = &packagesCacheMeta{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	}
+
+	bytesDownloaded = int64(len(body))
+
+	if entry, ok := checksums[relPath]; ok {
+		if err := verifySha256(relPath, body, entry.Sha256); err != nil {
+			return nil, bytesDownloaded, false, nil, err
 		}
-	} else if strings.HasSuffix(requestUrl, ".gz") {
-		reader, err = gzip.NewReader(resp.Body)
+	} else if !trusted {
+		return nil, bytesDownloaded, false, nil, fmt.Errorf("No checksum listed for %s in Release, refusing to trust it", relPath)
+	}
+
+	var reader io.Reader
+	bodyReader := bytes.NewReader(body)
+
+	if strings.HasSuffix(relPath, ".xz") {
+		reader, err = xz.NewReader(bodyReader)
 
 		if err != nil {
-			return nil, err
+			return nil, bytesDownloaded, false, nil, err
 		}
-	} else {
-		reader = resp.Body
+	} else if strings.HasSuffix(relPath, ".gz") {
+		reader, err = gzip.NewReader(bodyReader)
 
 		if err != nil {
-			return nil, err
+			return nil, bytesDownloaded, false, nil, err
 		}
+	} else {
+		reader = bodyReader
 	}
 
 	output, err := io.ReadAll(reader)
 
 	if err != nil {
-		return nil, err
+		return nil, bytesDownloaded, false, nil, err
+	}
+
+	sum := sha256.Sum256(output)
+	newMeta.Sha256 = hex.EncodeToString(sum[:])
+
+	if cached != nil && cached.Sha256 == newMeta.Sha256 {
+		return nil, bytesDownloaded, true, newMeta, nil
 	}
 
-	return parsePackagesFile(urlPrefix, string(output)), nil
+	return parsePackagesFile(urlPrefix, string(output)), bytesDownloaded, false, newMeta, nil
 }
 
-func pullAptRepository(directory string, url string, dist string, component string, architecture string) error {
-	definition, err := pullPackagesFile(url, dist, component, architecture)
+// pullPackagesFileViaBackend fetches a Packages file (and its .xz/.gz
+// variants, in order) through the Backend matching baseUrl's scheme.
+// Conditional requests and redirect-based suffix detection aren't available
+// off a Backend, so a found candidate's own relPath suffix is returned
+// alongside its body instead of being inferred from the response.
+func pullPackagesFileViaBackend(ctx context.Context, baseUrl string, relPath string) ([]byte, string, error) {
+	backend, err := NewBackend(baseUrl)
 
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+
+	for _, suffix := range []string{"", ".xz", ".gz"} {
+		candidate := baseUrl + suffix
+		reader, err := backend.Open(ctx, PackageRef{Url: candidate})
+
+		if err != nil {
+			continue
+		}
+
+		body, err := io.ReadAll(reader)
+		reader.Close()
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		return body, relPath + suffix, nil
+	}
+
+	return nil, "", nil
+}
+
+func pullAptRepository(ctx context.Context, directory string, url string, dist string, component string, architecture string, provider PackageListsProvider) (int64, bool, error) {
+	var checksums map[string]releaseFileEntry
+
+	if provider.Trusted {
+		checksums = map[string]releaseFileEntry{}
+	} else {
+		var err error
+		checksums, err = fetchVerifiedRelease(ctx, url, dist, provider)
+
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	filePath := filepath.Join(directory, dist, fmt.Sprintf("%s.yaml", component))
+	cached := loadPackagesCacheMeta(filePath + ".zst")
+
+	definition, bytesDownloaded, cacheHit, meta, err := pullPackagesFile(ctx, url, dist, component, architecture, checksums, provider.Trusted, cached)
+
+	if err != nil {
+		return bytesDownloaded, false, err
+	}
+
+	if cacheHit {
+		if meta != nil {
+			_ = savePackagesCacheMeta(filePath+".zst", meta)
+		}
+
+		return bytesDownloaded, true, nil
 	}
 
 	if definition != nil && len(definition.Xdeb) > 0 {
 		LogMessage("Syncing repository %s/%s: %s", filepath.Base(directory), dist, component)
 
-		filePath := filepath.Join(directory, dist, fmt.Sprintf("%s.yaml", component))
 		data, err := yaml.Marshal(definition)
 
 		if err != nil {
-			return err
+			return bytesDownloaded, false, err
+		}
+
+		compressedPath, err := writeFile(filePath, data, true)
+
+		if err != nil {
+			return bytesDownloaded, false, err
+		}
+
+		if meta != nil {
+			if err := savePackagesCacheMeta(compressedPath, meta); err != nil {
+				return bytesDownloaded, false, err
+			}
 		}
+	}
+
+	return bytesDownloaded, false, nil
+}
+
+// pullDirectoryRepository lists a Backend directly for .deb files rather
+// than parsing a Debian/pacman index, so a corporate S3 bucket or a mounted
+// NFS/WebDAV share of vendored packages works without an index server.
+func pullDirectoryRepository(ctx context.Context, directory string, urlPrefix string) (int64, error) {
+	backend, err := NewBackend(urlPrefix)
 
-		if _, err = writeFile(filePath, data, true); err != nil {
-			return err
+	if err != nil {
+		return 0, err
+	}
+
+	refs, err := backend.List(ctx)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(refs) == 0 {
+		return 0, nil
+	}
+
+	LogMessage("Syncing repository %s", filepath.Base(directory))
+
+	definition := XdebProviderDefinition{}
+
+	for _, ref := range refs {
+		name := strings.TrimSuffix(ref.Name, ".deb")
+		version := ""
+
+		if parts := strings.SplitN(name, "_", 2); len(parts) == 2 {
+			name, version = parts[0], parts[1]
 		}
+
+		definition.Xdeb = append(definition.Xdeb, XdebPackageDefinition{
+			Name:    name,
+			Version: version,
+			Url:     ref.Url,
+		})
+	}
+
+	filePath := filepath.Join(directory, "packages.yaml")
+	data, err := yaml.Marshal(definition)
+
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	_, err = writeFile(filePath, data, true)
+	return 0, err
 }
 
-func pullCustomRepository(directory string, urlPrefix string, dist string, component string) error {
+func pullCustomRepository(ctx context.Context, directory string, urlPrefix string, dist string, component string, mirrors []string) (int64, error) {
 	LogMessage("Syncing repository %s/%s: %s", filepath.Base(urlPrefix), dist, component)
 
 	url := fmt.Sprintf("%s/%s/%s", urlPrefix, dist, component)
-	_, err := DownloadFile(filepath.Join(directory, dist), url, false, true)
+	mirrorUrls := make([]string, len(mirrors))
+
+	for i, mirror := range mirrors {
+		mirrorUrls[i] = fmt.Sprintf("%s/%s/%s", mirror, dist, component)
+	}
+
+	fullPath, err := DownloadFile(ctx, filepath.Join(directory, dist), url, false, true, "", mirrorUrls, nil)
+
+	if err != nil {
+		return 0, err
+	}
 
-	return err
+	info, err := os.Stat(fullPath)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
 }
 
 func ParsePackageLists(path string, arch string) (*PackageListsDefinition, error) {
 	url := fmt.Sprintf(XDEB_INSTALL_REPOSITORIES_URL, XDEB_INSTALL_REPOSITORIES_TAG, arch)
 	LogMessage("Syncing lists: %s", url)
 
-	listsFile, err := DownloadFile(path, url, true, true)
+	listsFile, err := DownloadFile(context.Background(), path, url, true, true, "", nil, nil)
 
 	if err != nil {
 		return nil, err
@@ -205,7 +470,125 @@ func ParsePackageLists(path string, arch string) (*PackageListsDefinition, error
 	return lists, nil
 }
 
-func SyncRepositories(path string, lists *PackageListsDefinition, providerNames ...string) error {
+// SyncJobResult reports the outcome of syncing one (provider, distribution,
+// component) triple, so a caller can render a summary table or decide
+// whether to treat a partial sync failure as fatal.
+type SyncJobResult struct {
+	Provider     string
+	Distribution string
+	Component    string
+	Bytes        int64
+	Duration     time.Duration
+	CacheHit     bool
+	Err          error
+}
+
+type syncJob struct {
+	provider     PackageListsProvider
+	distribution string
+	component    string
+}
+
+// syncWorkerCount is how many (provider, distribution, component) jobs run
+// concurrently across all providers.
+func syncWorkerCount() int {
+	if n := runtime.NumCPU(); n > 0 {
+		return n
+	}
+
+	return 1
+}
+
+const (
+	syncMaxAttempts  = 4
+	syncInitialDelay = 500 * time.Millisecond
+)
+
+// isTransientSyncError reports whether a job failure looks like a transient
+// network condition (5xx, connection reset, timeout) worth retrying, as
+// opposed to a permanent one like a malformed provider URL or a 4xx.
+func isTransientSyncError(err error) bool {
+	var netErr net.Error
+
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ETIMEDOUT) {
+		return true
+	}
+
+	var statusErr *HTTPStatusError
+
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// runSyncJob runs one sync job, retrying transient failures with
+// exponential backoff and jitter, and returns a structured result rather
+// than aborting the whole sync on the first error.
+func runSyncJob(ctx context.Context, path string, job syncJob) SyncJobResult {
+	result := SyncJobResult{
+		Provider:     job.provider.Name,
+		Distribution: job.distribution,
+		Component:    job.component,
+	}
+
+	directory := filepath.Join(path, job.provider.Name)
+	delay := syncInitialDelay
+	started := time.Now()
+
+	for attempt := 1; attempt <= syncMaxAttempts; attempt++ {
+		var bytesDownloaded int64
+		var cacheHit bool
+		var err error
+
+		switch providerKind(job.provider) {
+		case "arch":
+			bytesDownloaded, err = pullArchRepository(ctx, directory, job.provider.Url, job.provider.Path, job.distribution, job.provider.Architecture)
+		case "directory":
+			bytesDownloaded, err = pullDirectoryRepository(ctx, directory, job.provider.Url)
+		case "custom":
+			bytesDownloaded, err = pullCustomRepository(ctx, directory, job.provider.Url, job.distribution, job.component, job.provider.Mirrors)
+		default:
+			bytesDownloaded, cacheHit, err = pullAptRepository(ctx, directory, job.provider.Url, job.distribution, job.component, job.provider.Architecture, job.provider)
+		}
+
+		result.Bytes = bytesDownloaded
+		result.CacheHit = cacheHit
+		result.Err = err
+
+		if err == nil || !isTransientSyncError(err) || attempt == syncMaxAttempts {
+			break
+		}
+
+		jitter := time.Duration(rand.Int63n(int64(delay)))
+
+		select {
+		case <-time.After(delay + jitter):
+		case <-ctx.Done():
+			result.Err = ctx.Err()
+			result.Duration = time.Since(started)
+			return result
+		}
+
+		delay *= 2
+	}
+
+	result.Duration = time.Since(started)
+	return result
+}
+
+// SyncRepositories syncs every (provider, distribution, component) job
+// across all selected providers through a bounded worker pool, instead of
+// one goroutine per provider run serially. Transient HTTP failures are
+// retried with backoff; every job's outcome is returned, and any failures
+// are joined into a single error so callers see the full picture instead of
+// just the first failure.
+func SyncRepositories(ctx context.Context, path string, lists *PackageListsDefinition, providerNames ...string) ([]SyncJobResult, error) {
 	availableProviderNames := []string{}
 
 	for _, provider := range lists.Providers {
@@ -214,7 +597,7 @@ func SyncRepositories(path string, lists *PackageListsDefinition, providerNames
 
 	for _, providerName := range providerNames {
 		if !slices.Contains(availableProviderNames, providerName) {
-			return fmt.Errorf("Provider %s not supported. Omit or use any of %v", providerName, availableProviderNames)
+			return nil, fmt.Errorf("Provider %s not supported. Omit or use any of %v", providerName, availableProviderNames)
 		}
 	}
 
@@ -230,48 +613,75 @@ func SyncRepositories(path string, lists *PackageListsDefinition, providerNames
 		providers = append(providers, lists.Providers...)
 	}
 
-	operations := 0
+	jobs := []syncJob{}
 
 	for _, provider := range providers {
-		for range provider.Distributions {
-			for range provider.Components {
-				operations++
+		switch providerKind(provider) {
+		case "arch":
+			// Arch repositories are identified by distribution alone; there's
+			// no component axis to cross with, so scheduling one job per
+			// (distribution, component) pair would refetch and reparse the
+			// same .db.tar.* once per component.
+			for _, distribution := range provider.Distributions {
+				jobs = append(jobs, syncJob{provider: provider, distribution: distribution})
 			}
-		}
-	}
 
-	for _, provider := range providers {
-		errors := make(chan error, operations)
-		var wg sync.WaitGroup
+			continue
+		case "directory":
+			// A directory listing has no distribution or component axis at
+			// all; it's a single Backend.List call per provider.
+			jobs = append(jobs, syncJob{provider: provider})
+			continue
+		}
 
 		for _, distribution := range provider.Distributions {
 			for _, component := range provider.Components {
-				wg.Add(1)
-
-				go func(p PackageListsProvider, d string, c string) {
-					defer wg.Done()
-					directory := filepath.Join(path, p.Name)
-
-					if p.Custom {
-						errors <- pullCustomRepository(directory, p.Url, d, c)
-					} else {
-						errors <- pullAptRepository(directory, p.Url, d, c, p.Architecture)
-					}
-				}(provider, distribution, component)
+				jobs = append(jobs, syncJob{provider: provider, distribution: distribution, component: component})
 			}
 		}
+	}
 
-		wg.Wait()
-		close(errors)
+	jobCh := make(chan syncJob)
+	resultCh := make(chan SyncJobResult, len(jobs))
+	var wg sync.WaitGroup
 
-		for i := 0; i < operations; i++ {
-			err := <-errors
+	for i := 0; i < syncWorkerCount(); i++ {
+		wg.Add(1)
 
-			if err != nil {
-				return err
+		go func() {
+			defer wg.Done()
+
+			for job := range jobCh {
+				resultCh <- runSyncJob(ctx, path, job)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobCh)
+
+		for _, job := range jobs {
+			select {
+			case jobCh <- job:
+			case <-ctx.Done():
+				return
 			}
 		}
+	}()
+
+	wg.Wait()
+	close(resultCh)
+
+	results := make([]SyncJobResult, 0, len(jobs))
+	var joined error
+
+	for result := range resultCh {
+		results = append(results, result)
+
+		if result.Err != nil {
+			joined = errors.Join(joined, fmt.Errorf("%s/%s/%s: %w", result.Provider, result.Distribution, result.Component, result.Err))
+		}
 	}
 
-	return nil
+	return results, joined
 }
@@ -0,0 +1,284 @@
+package xdeb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// releaseFileEntry is one row of the SHA256 section of a Debian Release
+// file: the checksum and size recorded for a file relative to the
+// dists/<dist>/ directory, e.g. "main/binary-amd64/Packages.xz".
+type releaseFileEntry struct {
+	Sha256 string
+	Size   int64
+}
+
+// parseReleaseChecksums extracts the "SHA256:" section of a Release file
+// into a lookup table keyed by the file's path relative to dists/<dist>/.
+func parseReleaseChecksums(release []byte) map[string]releaseFileEntry {
+	entries := map[string]releaseFileEntry{}
+	inSha256Section := false
+
+	for _, line := range strings.Split(string(release), "\n") {
+		if !strings.HasPrefix(line, " ") {
+			inSha256Section = strings.HasPrefix(line, "SHA256:")
+			continue
+		}
+
+		if !inSha256Section {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) != 3 {
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		entries[fields[2]] = releaseFileEntry{Sha256: fields[0], Size: size}
+	}
+
+	return entries
+}
+
+func openKeyring(keyringPath string) (openpgp.EntityList, error) {
+	file, err := os.Open(keyringPath)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not open keyring %s: %w", keyringPath, err)
+	}
+
+	defer file.Close()
+
+	keyring, err := openpgp.ReadArmoredKeyRing(file)
+
+	if err == nil {
+		return keyring, nil
+	}
+
+	if _, serr := file.Seek(0, io.SeekStart); serr != nil {
+		return nil, fmt.Errorf("Could not read keyring %s: %w", keyringPath, err)
+	}
+
+	keyring, err = openpgp.ReadKeyRing(file)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not read keyring %s: %w", keyringPath, err)
+	}
+
+	return keyring, nil
+}
+
+// verifyDetachedSignature checks that signature is a valid OpenPGP
+// signature over release, made by a key found in the armored or binary
+// keyring at keyringPath.
+func verifyDetachedSignature(release []byte, signature []byte, keyringPath string) error {
+	keyring, err := openKeyring(keyringPath)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(release), bytes.NewReader(signature)); err != nil {
+		return fmt.Errorf("Signature verification failed for keyring %s: %w", keyringPath, err)
+	}
+
+	return nil
+}
+
+// verifyClearSignedRelease verifies an InRelease file, which carries the
+// Release content and its own OpenPGP signature as a single clear-signed
+// message, and returns the embedded, signed plaintext.
+func verifyClearSignedRelease(inRelease []byte, keyringPath string) ([]byte, error) {
+	keyring, err := openKeyring(keyringPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := clearsign.Decode(inRelease)
+
+	if block == nil {
+		return nil, fmt.Errorf("InRelease is not a valid clear-signed message")
+	}
+
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body); err != nil {
+		return nil, fmt.Errorf("Signature verification failed for keyring %s: %w", keyringPath, err)
+	}
+
+	return block.Plaintext, nil
+}
+
+// fetchReleaseFile fetches candidateUrl, returning its body and status when
+// found. A status other than 200 alongside a nil error means "not found", so
+// callers can fall back to the next candidate in the InRelease/Release chain:
+// over HTTP(S) it is the response's own status code, through a Backend it is 0.
+// urlPrefix's scheme decides how the fetch happens: plain HTTP(S) issues a
+// direct GET, anything else (file://, s3://, webdav(s)://) goes through the
+// matching Backend, which has no notion of a status code beyond found/not.
+func fetchReleaseFile(ctx context.Context, urlPrefix string, candidateUrl string) ([]byte, int, error) {
+	parsed, err := neturl.Parse(urlPrefix)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if parsed.Scheme != "" && parsed.Scheme != "http" && parsed.Scheme != "https" {
+		backend, err := NewBackend(urlPrefix)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		reader, err := backend.Open(ctx, PackageRef{Url: candidateUrl})
+
+		if err != nil {
+			return nil, 0, nil
+		}
+
+		defer reader.Close()
+		body, err := io.ReadAll(reader)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return body, 200, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, candidateUrl, nil)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, resp.StatusCode, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return body, 200, nil
+}
+
+// fetchVerifiedRelease downloads dists/<dist>/InRelease, falling back to
+// Release+Release.gpg, and verifies its signature against provider.Keyring
+// unless provider.Trusted opts out of verification. It returns the
+// checksums of the component Packages files listed inside. urlPrefix's
+// scheme decides how each file is actually fetched; see fetchReleaseFile.
+func fetchVerifiedRelease(ctx context.Context, urlPrefix string, dist string, provider PackageListsProvider) (map[string]releaseFileEntry, error) {
+	inReleaseUrl := fmt.Sprintf("%s/dists/%s/InRelease", urlPrefix, dist)
+	body, status, err := fetchReleaseFile(ctx, urlPrefix, inReleaseUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if status == 200 {
+		if provider.Trusted {
+			return parseReleaseChecksums(body), nil
+		}
+
+		plaintext, err := verifyClearSignedRelease(body, provider.Keyring)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return parseReleaseChecksums(plaintext), nil
+	}
+
+	releaseUrl := fmt.Sprintf("%s/dists/%s/Release", urlPrefix, dist)
+	release, status, err := fetchReleaseFile(ctx, urlPrefix, releaseUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if status != 200 {
+		if status >= 500 {
+			return nil, &HTTPStatusError{URL: releaseUrl, StatusCode: status}
+		}
+
+		return nil, fmt.Errorf("Could not fetch Release for %s/%s", urlPrefix, dist)
+	}
+
+	if provider.Trusted {
+		return parseReleaseChecksums(release), nil
+	}
+
+	signature, sigStatus, err := fetchReleaseFile(ctx, urlPrefix, releaseUrl+".gpg")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if sigStatus != 200 {
+		return nil, fmt.Errorf("Could not fetch Release signature for %s/%s", urlPrefix, dist)
+	}
+
+	if err := verifyDetachedSignature(release, signature, provider.Keyring); err != nil {
+		return nil, err
+	}
+
+	return parseReleaseChecksums(release), nil
+}
+
+// ChecksumMismatchError indicates a downloaded file's SHA256 digest does
+// not match the digest recorded for it in a Release file or package
+// definition, so callers can retry the download from a different mirror
+// instead of trusting a possibly-tampered payload.
+type ChecksumMismatchError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("Checksum mismatch for %s: expected %s, got %s", e.Path, e.Expected, e.Actual)
+}
+
+func verifySha256(path string, data []byte, expected string) error {
+	if expected == "" {
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+	actual := hex.EncodeToString(sum[:])
+
+	if actual != expected {
+		return &ChecksumMismatchError{Path: path, Expected: expected, Actual: actual}
+	}
+
+	return nil
+}